@@ -0,0 +1,19 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !windows
+// +build !linux,!darwin,!windows
+
+package clickonce
+
+import (
+	"os"
+	"time"
+)
+
+// atime returns info's modification time: access time isn't reliably
+// available through os.FileInfo on this platform.
+func atime(info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,23 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package clickonce
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// atime returns the last access time recorded by the filesystem for info.
+func atime(info os.FileInfo) time.Time {
+	stat, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return info.ModTime()
+	}
+	return time.Unix(0, stat.LastAccessTime.Nanoseconds())
+}
@@ -0,0 +1,143 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"mime"
+	"path"
+	"strings"
+
+	"gocloud.dev/blob"
+	_ "gocloud.dev/blob/azureblob"
+	_ "gocloud.dev/blob/fileblob"
+	_ "gocloud.dev/blob/gcsblob"
+	_ "gocloud.dev/blob/s3blob"
+	"gocloud.dev/gcerrors"
+)
+
+// compressibleExtensions lists the deployed file extensions worth gzip-encoding.
+var compressibleExtensions = map[string]bool{
+	".js":       true,
+	".css":      true,
+	".json":     true,
+	".xml":      true,
+	".txt":      true,
+	".manifest": true,
+	".config":   true,
+}
+
+// SetOutputBucket opens a Go CDK blob bucket at bucketURL (e.g. "s3://bucket/prefix",
+// "gs://bucket/prefix", "azblob://container" or "file:///path") where deployed files
+// will be saved, in addition to or instead of SetOutputDir. ctx is only used to open
+// the bucket; the context passed to Get/GetContext governs the actual uploads.
+func (co *ClickOnce) SetOutputBucket(ctx context.Context, bucketURL string) error {
+	bucket, err := blob.OpenBucket(ctx, bucketURL)
+	if err != nil {
+		return err
+	}
+
+	co.outputBucket = bucket
+
+	return nil
+}
+
+// saveDeployedFileToBucket saves a deployed file of a ClickOnce application to the
+// configured output bucket, preserving the manifest-relative POSIX path as the key.
+func (co *ClickOnce) saveDeployedFileToBucket(ctx context.Context, deployedFilePath string, deployedFileContent []byte) error {
+	key := strings.Replace(deployedFilePath, "\\", "/", -1)
+
+	if co.subset != nil {
+		deployedFileName := path.Base(key)
+		if _, ok := co.subset[deployedFileName]; !ok {
+			co.logger.Printf("'%s' not in requested subset, skipped\n", deployedFileName)
+			return nil
+		}
+	}
+
+	body := deployedFileContent
+	gzipped := compressibleExtensions[path.Ext(key)]
+	if gzipped {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(deployedFileContent); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	// Compare against the same bytes that would be uploaded: the bucket's
+	// MD5 is of the stored (possibly gzip-encoded) object, not the original.
+	exists, err := co.bucketObjectUpToDate(ctx, key, body)
+	if err != nil {
+		return err
+	}
+	if exists {
+		co.logger.Printf("'%s' already up to date in bucket, skipped\n", key)
+		return nil
+	}
+
+	opts := &blob.WriterOptions{
+		ContentType: mime.TypeByExtension(path.Ext(key)),
+	}
+	if gzipped {
+		opts.ContentEncoding = "gzip"
+	}
+
+	co.logger.Println("Saving " + key + " to bucket")
+
+	w, err := co.outputBucket.NewWriter(ctx, key, opts)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	co.logger.Println("Saved " + key + " to bucket")
+	return nil
+}
+
+// bucketObjectUpToDate reports whether an object already in the bucket has an MD5
+// matching the locally computed hash of content, so unchanged files can be skipped.
+func (co *ClickOnce) bucketObjectUpToDate(ctx context.Context, key string, content []byte) (bool, error) {
+	attrs, err := co.outputBucket.Attributes(ctx, key)
+	if err != nil {
+		if gcerrors.Code(err) == gcerrors.NotFound {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if len(attrs.MD5) == 0 {
+		return false, nil
+	}
+
+	sum := md5.Sum(content)
+	return hex.EncodeToString(attrs.MD5) == hex.EncodeToString(sum[:]), nil
+}
+
+// saveAllDeployedFilesToBucket saves all wanted deployed files of a ClickOnce
+// application to the configured output bucket.
+func (co *ClickOnce) saveAllDeployedFilesToBucket(ctx context.Context) error {
+	for deployedFilePath, deployedFile := range co.deployedFiles {
+		err := co.saveDeployedFileToBucket(ctx, deployedFilePath, deployedFile.Content)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
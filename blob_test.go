@@ -0,0 +1,94 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClickOnce_SaveDeployedFileToBucket(t *testing.T) {
+	bucketDir, err := ioutil.TempDir("", "clickonce_bucket_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bucketDir)
+
+	ctx := context.Background()
+
+	var co ClickOnce
+	co.SetLogger(log.New(ioutil.Discard, "", 0))
+	if err := co.SetOutputBucket(ctx, "file://"+filepath.ToSlash(bucketDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	// app.config is compressible and should be gzip-encoded in the bucket.
+	if err := co.saveDeployedFileToBucket(ctx, "app.config", []byte("<configuration/>")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(bucketDir, "app.config")); err != nil {
+		t.Errorf("saveDeployedFileToBucket() should have written 'app.config' to the bucket: %v", err)
+	}
+
+	// app.exe is not a compressible extension and should be stored as is.
+	if err := co.saveDeployedFileToBucket(ctx, "app.exe", []byte("binary content")); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(bucketDir, "app.exe"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "binary content" {
+		t.Errorf("app.exe content = %q, want unmodified %q", raw, "binary content")
+	}
+}
+
+// TestClickOnce_SaveDeployedFileToBucketUpToDate guards against the bug where
+// bucketObjectUpToDate hashed the pre-gzip content: since the bucket stores
+// the post-gzip bytes for compressible extensions, re-saving identical
+// content must be recognized as already up to date and skipped.
+func TestClickOnce_SaveDeployedFileToBucketUpToDate(t *testing.T) {
+	bucketDir, err := ioutil.TempDir("", "clickonce_bucket_uptodate_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(bucketDir)
+
+	ctx := context.Background()
+
+	var co ClickOnce
+	co.SetLogger(log.New(ioutil.Discard, "", 0))
+	if err := co.SetOutputBucket(ctx, "file://"+filepath.ToSlash(bucketDir)); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("<configuration>same every time</configuration>")
+
+	if err := co.saveDeployedFileToBucket(ctx, "app.config", content); err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := os.Stat(filepath.Join(bucketDir, "app.config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := co.saveDeployedFileToBucket(ctx, "app.config", content); err != nil {
+		t.Fatal(err)
+	}
+
+	rewritten, err := os.Stat(filepath.Join(bucketDir, "app.config"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !rewritten.ModTime().Equal(written.ModTime()) {
+		t.Error("saveDeployedFileToBucket() should skip re-uploading unchanged content")
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SetCacheDir sets a local, content-addressed cache directory. Before
+// downloading a deployed file, its <algorithm>/<digest> is looked up under
+// path; a hit is reused with no network I/O, and every verified download is
+// written there on success. Because ClickOnce deploys are content-addressed
+// by digest in the manifest, unchanged assemblies across app versions (or
+// across apps sharing DLLs) can be served from cache.
+func (co *ClickOnce) SetCacheDir(path string) {
+	co.cacheDir = path
+}
+
+// SetOffline, when cacheDir is set, makes downloadAndCheck fail hard instead
+// of reaching the network whenever a required digest is missing from cache.
+// Useful for air-gapped rebuilds.
+func (co *ClickOnce) SetOffline(offline bool) {
+	co.cacheOnly = offline
+}
+
+// cachePath returns the path under cacheDir for a given algorithm/digest,
+// hex-encoding the digest so it is always a safe filename.
+func (co *ClickOnce) cachePath(algorithm, digest string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(digest)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(co.cacheDir, algorithm, hex.EncodeToString(raw)), nil
+}
+
+// readCache returns the cached payload for algorithm/digest, if any.
+func (co *ClickOnce) readCache(algorithm, digest string) ([]byte, bool) {
+	if co.cacheDir == "" {
+		return nil, false
+	}
+
+	path, err := co.cachePath(algorithm, digest)
+	if err != nil {
+		return nil, false
+	}
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+
+	return content, true
+}
+
+// writeCache stores a verified payload under algorithm/digest.
+func (co *ClickOnce) writeCache(algorithm, digest string, content []byte) error {
+	if co.cacheDir == "" {
+		return nil
+	}
+
+	path, err := co.cachePath(algorithm, digest)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// PruneCache deletes the least recently accessed files under cacheDir until
+// its total size is at or below maxBytes.
+func PruneCache(cacheDir string, maxBytes int64) error {
+	type cacheFile struct {
+		path  string
+		size  int64
+		atime time.Time
+	}
+
+	var files []cacheFile
+	var total int64
+
+	err := filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+
+		files = append(files, cacheFile{path, info.Size(), atime(info)})
+		total += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if total <= maxBytes {
+		return nil
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].atime.Before(files[j].atime)
+	})
+
+	for _, f := range files {
+		if total <= maxBytes {
+			break
+		}
+
+		if err := os.Remove(f.path); err != nil {
+			return err
+		}
+
+		total -= f.size
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClickOnce_ReadWriteCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "clickonce_cache_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	var co ClickOnce
+	co.SetCacheDir(cacheDir)
+
+	digest := base64.StdEncoding.EncodeToString([]byte("some sha256 digest"))
+	content := []byte("deployed file content")
+
+	if _, ok := co.readCache("sha256", digest); ok {
+		t.Error("readCache() should miss before writeCache()")
+	}
+
+	if err := co.writeCache("sha256", digest, content); err != nil {
+		t.Fatal(err)
+	}
+
+	got, ok := co.readCache("sha256", digest)
+	if !ok {
+		t.Fatal("readCache() should hit after writeCache()")
+	}
+	if string(got) != string(content) {
+		t.Errorf("readCache() = %q, want %q", got, content)
+	}
+}
+
+func TestClickOnce_ReadCacheWithoutCacheDir(t *testing.T) {
+	var co ClickOnce
+	if _, ok := co.readCache("sha256", "anything"); ok {
+		t.Error("readCache() should always miss when SetCacheDir was never called")
+	}
+}
+
+// TestPruneCache checks that PruneCache brings total cache size at or below
+// maxBytes, without asserting which specific files survive: file atimes
+// have coarse and filesystem-dependent resolution, so pinning the exact
+// eviction order here would be flaky.
+func TestPruneCache(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "clickonce_prune_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	const fileSize = 100
+	const fileCount = 5
+	for i := 0; i < fileCount; i++ {
+		name := filepath.Join(cacheDir, "sha256", string(rune('a'+i)))
+		if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, make([]byte, fileSize), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const maxBytes = fileSize * 2
+
+	if err := PruneCache(cacheDir, maxBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	err = filepath.Walk(cacheDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if total > maxBytes {
+		t.Errorf("PruneCache() left %d bytes, want at most %d", total, maxBytes)
+	}
+}
+
+func TestPruneCache_UnderLimit(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "clickonce_prune_under_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	name := filepath.Join(cacheDir, "sha256", "onlyfile")
+	if err := os.MkdirAll(filepath.Dir(name), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, make([]byte, 10), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PruneCache(cacheDir, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(name); err != nil {
+		t.Error("PruneCache() should not remove files when already under maxBytes")
+	}
+}
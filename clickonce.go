@@ -8,8 +8,10 @@ package clickonce
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
@@ -23,9 +25,13 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
+	"gocloud.dev/blob"
 	// Common text encodings for HTML documents
 	"golang.org/x/net/html/charset"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
 )
 
 type coType int
@@ -53,10 +59,32 @@ type ClickOnce struct {
 	baseUrl       *url.URL
 	assembly      *coAssembly
 	outputDir     string
+	outputBucket  *blob.Bucket
 	noSuffix      bool
 	offline       bool
 	notFound      int
 	logger        *log.Logger
+
+	lockPath    string
+	lock        *Lock
+	dynamic     bool
+	tagInclude  []string
+	tagExclude  []string
+	pendingTags map[string][]string
+
+	mu           sync.Mutex
+	concurrency  int
+	progress     ProgressReporter
+	rateLimit    float64
+	rateMu       sync.Mutex
+	rateLimiters map[string]*rate.Limiter
+
+	cacheDir  string
+	cacheOnly bool
+
+	trustedRoots    *x509.CertPool
+	signaturePolicy SignaturePolicy
+	publisher       string
 }
 
 type remoteFile struct {
@@ -141,7 +169,7 @@ func (co *ClickOnce) Init(appUrl string) error {
 		return errors.New("application file is empty")
 	}
 
-	co.assembly, err = decodeManifest(appContent)
+	co.assembly, err = co.decodeManifest(appContent)
 	if err != nil {
 		return err
 	}
@@ -223,6 +251,12 @@ func (co *ClickOnce) findSubset(subset []string) error {
 // Get download only a subset of all files required or used by ClickOnce application.
 // If subset is nil or empty, all files are downloaded.
 func (co *ClickOnce) Get(subset []string) error {
+	return co.GetContext(context.Background(), subset)
+}
+
+// GetContext is like Get but allows callers to cancel or time out a large
+// download through ctx.
+func (co *ClickOnce) GetContext(ctx context.Context, subset []string) error {
 	if co.baseUrl == nil || co.assembly == nil {
 		return errors.New("clickonce not initialized")
 	}
@@ -237,7 +271,7 @@ func (co *ClickOnce) Get(subset []string) error {
 	}
 
 	if !co.offline {
-		err := co.retrieveAllDeployedFiles(co.assembly)
+		err := co.retrieveAllDeployedFiles(ctx, co.assembly)
 		if err != nil {
 			return err
 		}
@@ -264,6 +298,17 @@ func (co *ClickOnce) Get(subset []string) error {
 		}
 	}
 
+	if co.outputBucket != nil {
+		err := co.saveAllDeployedFilesToBucket(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := co.saveLock(); err != nil {
+		return err
+	}
+
 	if validSubset && co.notFound != 0 {
 		return errors.New("not all or requested files are found")
 	}
@@ -290,7 +335,7 @@ func (co *ClickOnce) remoteFileInfo(deployedFileUrl *url.URL, deployedFile coBas
 }
 
 // retrieveDeployedFile get a deployed file of a ClickOnce application if it's in the requested subset.
-func (co *ClickOnce) retrieveDeployedFile(deployedFilePath string, deployedFile coBase, deployedFileType coType) error {
+func (co *ClickOnce) retrieveDeployedFile(ctx context.Context, sem chan struct{}, deployedFilePath string, deployedFile coBase, deployedFileType coType) error {
 	if deployedFilePath == "" {
 		co.logger.Println("Missing valid path, skipped")
 		return nil
@@ -301,20 +346,25 @@ func (co *ClickOnce) retrieveDeployedFile(deployedFilePath string, deployedFile
 
 	manifest := isManifest(deployedFileName)
 
+	co.mu.Lock()
+
 	if co.subset != nil && !manifest {
 		if _, ok := co.subset[deployedFileName]; !ok {
+			co.mu.Unlock()
 			co.logger.Printf("'%s' not in requested subset, skipped\n", deployedFileName)
 			return nil
 		}
 	}
 
 	if _, ok := co.deployedFiles[deployedFilePath]; ok {
+		co.mu.Unlock()
 		co.logger.Printf("'%s' already downloaded, skipped\n", deployedFilePath)
 		return nil
 	}
 
 	deployedFileUrl, err := co.baseUrl.Parse(deployedFilePosixPath)
 	if err != nil {
+		co.mu.Unlock()
 		return err
 	}
 
@@ -322,15 +372,40 @@ func (co *ClickOnce) retrieveDeployedFile(deployedFilePath string, deployedFile
 		co.baseUrl = deployedFileUrl
 	}
 
+	noSuffix := co.noSuffix
+
+	co.mu.Unlock()
+
 	remoteFile, err := co.remoteFileInfo(deployedFileUrl, deployedFile)
 	if err != nil {
 		return err
 	}
 
-	deployedFileContent, suffix, err := downloadAndCheck(remoteFile, !co.noSuffix, co.logger)
+	remoteFile, wanted, err := co.checkLock(deployedFilePath, remoteFile)
 	if err != nil {
 		return err
 	}
+	if !wanted {
+		co.logger.Printf("'%s' excluded by tag filters, skipped\n", deployedFilePath)
+		return nil
+	}
+
+	// Only the download itself counts against sem. Manifest processing below
+	// recurses into subApplication, which submits its own children to the
+	// same shared sem; holding a token across that wait would deadlock as
+	// soon as concurrency <= the manifest nesting depth.
+	select {
+	case sem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	deployedFileContent, suffix, err := co.downloadAndCheck(ctx, deployedFilePath, remoteFile, !noSuffix)
+	<-sem
+	if err != nil {
+		return err
+	}
+
+	co.mu.Lock()
 
 	co.noSuffix = !suffix
 
@@ -349,8 +424,10 @@ func (co *ClickOnce) retrieveDeployedFile(deployedFilePath string, deployedFile
 		co.subset[deployedFileName] = true
 	}
 
+	co.mu.Unlock()
+
 	if manifest {
-		err = co.subApplication(deployedFileContent)
+		err = co.subApplication(ctx, sem, deployedFileContent)
 		if err != nil {
 			return err
 		}
@@ -359,14 +436,16 @@ func (co *ClickOnce) retrieveDeployedFile(deployedFilePath string, deployedFile
 	return nil
 }
 
-// subApplication decode a manifest and retrieve all deployed files related to a sub application.
-func (co *ClickOnce) subApplication(manifestContent []byte) (err error) {
-	assembly, err := decodeManifest(manifestContent)
+// subApplication decode a manifest and retrieve all deployed files related to a sub
+// application, sharing sem with the parent fetch so SetConcurrency is honored
+// across the whole recursive tree, not just within one manifest.
+func (co *ClickOnce) subApplication(ctx context.Context, sem chan struct{}, manifestContent []byte) (err error) {
+	assembly, err := co.decodeManifest(manifestContent)
 	if err != nil {
 		return
 	}
 
-	err = co.retrieveAllDeployedFiles(assembly)
+	err = co.retrieveAllDeployedFilesSem(ctx, assembly, sem)
 	if err != nil {
 		return
 	}
@@ -374,27 +453,39 @@ func (co *ClickOnce) subApplication(manifestContent []byte) (err error) {
 	return
 }
 
-// retrieveAllDeployedFiles get all wanted deployed files of a ClickOnce application.
-func (co *ClickOnce) retrieveAllDeployedFiles(assembly *coAssembly) error {
+// retrieveAllDeployedFiles get all wanted deployed files of a ClickOnce application,
+// fetching up to co.concurrencyLimit() of them in parallel. The first hard error
+// cancels remaining work; soft errors (skips) are simply logged.
+func (co *ClickOnce) retrieveAllDeployedFiles(ctx context.Context, assembly *coAssembly) error {
+	sem := make(chan struct{}, co.concurrencyLimit())
+	return co.retrieveAllDeployedFilesSem(ctx, assembly, sem)
+}
+
+// retrieveAllDeployedFilesSem is retrieveAllDeployedFiles with sem shared across
+// recursive sub-manifest fetches, so co.concurrencyLimit() bounds the total number
+// of in-flight downloads rather than just those of a single manifest level.
+func (co *ClickOnce) retrieveAllDeployedFilesSem(ctx context.Context, assembly *coAssembly, sem chan struct{}) error {
+	g, ctx := errgroup.WithContext(ctx)
+
 	for _, dependentAssembly := range assembly.DependentAssembly {
+		dependentAssembly := dependentAssembly
 		if dependentAssembly.DependencyType != "install" {
 			co.logger.Println("Found dependency not to install, skipped")
 			continue
 		}
-		err := co.retrieveDeployedFile(dependentAssembly.Codebase, dependentAssembly.coBase, AssemblyDependency)
-		if err != nil {
-			return nil
-		}
+		g.Go(func() error {
+			return co.retrieveDeployedFile(ctx, sem, dependentAssembly.Codebase, dependentAssembly.coBase, AssemblyDependency)
+		})
 	}
 
 	for _, f := range assembly.File {
-		err := co.retrieveDeployedFile(f.Name, f.coBase, NonAssemblyFile)
-		if err != nil {
-			return nil
-		}
+		f := f
+		g.Go(func() error {
+			return co.retrieveDeployedFile(ctx, sem, f.Name, f.coBase, NonAssemblyFile)
+		})
 	}
 
-	return nil
+	return g.Wait()
 }
 
 // saveAllDeployedFile saves a deployed file of a ClickOnce application if it's in the requested subset.
@@ -440,8 +531,9 @@ func isManifest(filename string) bool {
 	return path.Ext(filename) == manifestExtension
 }
 
-// decodeManifest decodes a ClickOnce manifest.
-func decodeManifest(data []byte) (*coAssembly, error) {
+// decodeManifest decodes a ClickOnce manifest and verifies its signature
+// according to the configured SignaturePolicy.
+func (co *ClickOnce) decodeManifest(data []byte) (*coAssembly, error) {
 	dec := xml.NewDecoder(bytes.NewBuffer(data))
 	dec.CharsetReader = charset.NewReaderLabel
 	dec.Strict = false
@@ -451,41 +543,73 @@ func decodeManifest(data []byte) (*coAssembly, error) {
 		return nil, err
 	}
 
+	if err := co.verifyManifestSignature(data); err != nil {
+		return nil, err
+	}
+
 	return &assembly, nil
 }
 
-// download returns an HTTP response from a URL.
-func download(url string) (res *http.Response, err error) {
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return
-	}
+// download returns an HTTP response from a URL, retrying on network errors
+// and 5xx responses with exponential backoff, and honouring limiter if set.
+func download(ctx context.Context, logger *log.Logger, limiter *rate.Limiter, url string) (res *http.Response, err error) {
+	err = retryWithBackoff(ctx, logger, func() error {
+		if limiter != nil {
+			if err := limiter.Wait(ctx); err != nil {
+				return err
+			}
+		}
 
-	res, err = http.DefaultClient.Do(req)
-	if err != nil {
-		return
-	}
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+
+		if r.StatusCode >= http.StatusInternalServerError {
+			_ = r.Body.Close()
+			return fmt.Errorf("server error %d for '%s'", r.StatusCode, url)
+		}
+
+		res = r
+		return nil
+	})
 
 	return
 }
 
-// downloadAndCheck get a remote file and check size and checksum.
-func downloadAndCheck(file *remoteFile, suffix bool, logger *log.Logger) ([]byte, bool, error) {
+// downloadAndCheck get a remote file and check size and checksum, reporting
+// progress through the configured ProgressReporter if set. A configured
+// cache directory is consulted before the network and populated on success.
+func (co *ClickOnce) downloadAndCheck(ctx context.Context, deployedFilePath string, file *remoteFile, suffix bool) ([]byte, bool, error) {
 	filename := filepath.Base(file.url.Path)
 
 	if file.algorithm != "sha1" && file.algorithm != "sha256" {
 		return nil, suffix, errors.New(file.algorithm + " digest algorithm not supported for '" + filename + "'")
 	}
 
+	if body, ok := co.readCache(file.algorithm, file.digest); ok {
+		co.logger.Printf("'%s' found in cache, download skipped\n", filename)
+		return body, suffix, nil
+	}
+
+	if co.cacheOnly {
+		return nil, suffix, fmt.Errorf("'%s' not found in cache and offline mode is enabled", filename)
+	}
+
 	downloadUrl := file.url.String()
 
 	if suffix && !isManifest(filepath.Base(file.url.Path)) {
 		downloadUrl += deployedFileExtension
 	}
 
-	logger.Printf("Downloading '%s' from '%s'\n", filename, downloadUrl)
+	co.logger.Printf("Downloading '%s' from '%s'\n", filename, downloadUrl)
 
-	res, err := download(downloadUrl)
+	res, err := download(ctx, co.logger, co.limiterFor(file.url.Host), downloadUrl)
 	if err != nil {
 		return nil, suffix, err
 	}
@@ -495,9 +619,9 @@ func downloadAndCheck(file *remoteFile, suffix bool, logger *log.Logger) ([]byte
 
 		downloadUrl := strings.TrimSuffix(downloadUrl, path.Ext(downloadUrl))
 
-		logger.Printf("Not found, trying to download '%s' from '%s'\n", filename, downloadUrl)
+		co.logger.Printf("Not found, trying to download '%s' from '%s'\n", filename, downloadUrl)
 
-		res, err := download(downloadUrl)
+		res, err := download(ctx, co.logger, co.limiterFor(file.url.Host), downloadUrl)
 		if err != nil {
 			return nil, suffix, err
 		}
@@ -506,11 +630,11 @@ func downloadAndCheck(file *remoteFile, suffix bool, logger *log.Logger) ([]byte
 			return nil, suffix, errors.New("no file available at '" + downloadUrl + "'")
 		}
 
-		logger.Printf("Application files deployed without default '%s' suffix", deployedFileExtension)
+		co.logger.Printf("Application files deployed without default '%s' suffix", deployedFileExtension)
 		suffix = false
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	body, err := ioutil.ReadAll(newProgressReader(res.Body, deployedFilePath, int64(file.size), co.progress))
 	if err != nil {
 		return nil, suffix, err
 	}
@@ -525,21 +649,38 @@ func downloadAndCheck(file *remoteFile, suffix bool, logger *log.Logger) ([]byte
 			filename, file.size, len(body))
 	}
 
+	digest, err := digestFor(file.algorithm, body)
+	if err != nil {
+		return nil, suffix, err
+	}
+
+	if file.digest != digest {
+		return nil, suffix, fmt.Errorf("digest mismatch for file '%s'", filename)
+	}
+
+	co.logger.Printf("Downloaded '%s'\n", filename)
+
+	if err := co.writeCache(file.algorithm, file.digest, body); err != nil {
+		return nil, suffix, err
+	}
+
+	return body, suffix, nil
+}
+
+// digestFor computes the base64-encoded digest of body with the given algorithm.
+func digestFor(algorithm string, body []byte) (string, error) {
 	var checksum []byte
 
-	if file.algorithm == "sha1" {
+	switch algorithm {
+	case "sha1":
 		checksumSHA1 := sha1.Sum(body)
 		checksum = checksumSHA1[:]
-	} else {
+	case "sha256":
 		checksumSHA256 := sha256.Sum256(body)
 		checksum = checksumSHA256[:]
+	default:
+		return "", errors.New(algorithm + " digest algorithm not supported")
 	}
 
-	if file.digest != base64.StdEncoding.EncodeToString(checksum) {
-		return nil, suffix, fmt.Errorf("digest mismatch for file '%s'", filename)
-	}
-
-	logger.Printf("Downloaded '%s'\n", filename)
-
-	return body, suffix, nil
+	return base64.StdEncoding.EncodeToString(checksum), nil
 }
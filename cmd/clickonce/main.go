@@ -0,0 +1,112 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Command clickonce downloads a ClickOnce application, pinning it to a
+// reproducible lock file (clickonce.lock unless -lock names another).
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/whitone/clickonce"
+)
+
+// tagList collects repeated -tag/-notag flags into a slice.
+type tagList []string
+
+func (t *tagList) String() string {
+	return fmt.Sprint([]string(*t))
+}
+
+func (t *tagList) Set(value string) error {
+	*t = append(*t, value)
+	return nil
+}
+
+// fileTagList collects repeated -filetag "name=tag1,tag2" flags.
+type fileTagList map[string][]string
+
+func (f fileTagList) String() string {
+	return fmt.Sprint(map[string][]string(f))
+}
+
+func (f fileTagList) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid -filetag %q, expected \"name=tag1,tag2\"", value)
+	}
+	f[parts[0]] = strings.Split(parts[1], ",")
+	return nil
+}
+
+func main() {
+	var (
+		appUrl    = flag.String("url", "", "ClickOnce application manifest URL")
+		outputDir = flag.String("output", "", "directory where to save deployed files")
+		cacheDir  = flag.String("cache", "", "content-addressed cache directory to reuse across runs")
+		lockFile  = flag.String("lock", "clickonce.lock", "path of the lock file")
+		dynamic   = flag.Bool("dynamic", false, "allow the lock to be refreshed when the manifest legitimately changed")
+		verify    = flag.Bool("verify", false, "verify already downloaded files against the lock without network I/O")
+		tag       tagList
+		notag     tagList
+		fileTags  = make(fileTagList)
+	)
+	flag.Var(&tag, "tag", "only fetch lock entries tagged with this value (repeatable)")
+	flag.Var(&notag, "notag", "exclude lock entries tagged with this value (repeatable)")
+	flag.Var(&fileTags, "filetag", "tag a file as \"name=tag1,tag2\" before it's first added to the lock (repeatable)")
+	flag.Parse()
+
+	logger := log.New(os.Stderr, "", 0)
+
+	var co clickonce.ClickOnce
+	co.SetLogger(logger)
+
+	if err := co.SetLockFile(*lockFile); err != nil {
+		logger.Fatal(err)
+	}
+
+	co.SetDynamic(*dynamic)
+	if len(tag) > 0 {
+		co.SetTags(tag)
+	}
+	if len(notag) > 0 {
+		co.SetNoTags(notag)
+	}
+	for name, tags := range fileTags {
+		co.SetFileTags(name, tags...)
+	}
+
+	if *outputDir != "" {
+		co.SetOutputDir(*outputDir)
+	}
+	if *cacheDir != "" {
+		co.SetCacheDir(*cacheDir)
+	}
+
+	if *verify {
+		// Verify re-hashes whatever was already downloaded to -output (or to
+		// -cache) by a prior run; it does not fetch anything itself.
+		if err := co.Verify(); err != nil {
+			logger.Fatal(err)
+		}
+		fmt.Println("clickonce.lock verified")
+		return
+	}
+
+	if *appUrl == "" {
+		logger.Fatal("missing -url")
+	}
+
+	if err := co.Init(*appUrl); err != nil {
+		logger.Fatal(err)
+	}
+
+	if err := co.GetAll(); err != nil {
+		logger.Fatal(err)
+	}
+}
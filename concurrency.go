@@ -0,0 +1,138 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// defaultConcurrency is used when SetConcurrency hasn't been called.
+const defaultConcurrency = 4
+
+// A ProgressReporter is notified as a deployed file is downloaded.
+type ProgressReporter interface {
+	// Progress reports that bytesDownloaded out of totalBytes have been
+	// downloaded for deployedFilePath. totalBytes is the size declared in
+	// the manifest.
+	Progress(deployedFilePath string, bytesDownloaded, totalBytes int64)
+}
+
+// SetConcurrency sets how many deployed files are downloaded in parallel.
+// n <= 0 restores the default of 4.
+func (co *ClickOnce) SetConcurrency(n int) {
+	co.concurrency = n
+}
+
+// concurrencyLimit returns the configured concurrency, or the default.
+func (co *ClickOnce) concurrencyLimit() int {
+	if co.concurrency <= 0 {
+		return defaultConcurrency
+	}
+	return co.concurrency
+}
+
+// SetProgressReporter sets the ProgressReporter notified of download progress.
+func (co *ClickOnce) SetProgressReporter(reporter ProgressReporter) {
+	co.progress = reporter
+}
+
+// SetRateLimit caps downloads from a single host to requestsPerSecond.
+// A value <= 0 disables rate limiting, which is the default.
+func (co *ClickOnce) SetRateLimit(requestsPerSecond float64) {
+	co.rateLimit = requestsPerSecond
+}
+
+// limiterFor returns the rate.Limiter for host, creating it on first use,
+// or nil if no rate limit is configured.
+func (co *ClickOnce) limiterFor(host string) *rate.Limiter {
+	if co.rateLimit <= 0 {
+		return nil
+	}
+
+	co.rateMu.Lock()
+	defer co.rateMu.Unlock()
+
+	if co.rateLimiters == nil {
+		co.rateLimiters = make(map[string]*rate.Limiter)
+	}
+
+	limiter, ok := co.rateLimiters[host]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(co.rateLimit), 1)
+		co.rateLimiters[host] = limiter
+	}
+
+	return limiter
+}
+
+const (
+	maxRetries  = 5
+	baseBackoff = 200 * time.Millisecond
+	maxBackoff  = 10 * time.Second
+)
+
+// retryWithBackoff retries fn, which should return a retriable error (a
+// network error or a 5xx response), up to maxRetries times with exponential
+// backoff and jitter between attempts.
+func retryWithBackoff(ctx context.Context, logger *log.Logger, fn func() error) error {
+	var err error
+
+	for attempt := 0; attempt <= maxRetries; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		if attempt == maxRetries {
+			break
+		}
+
+		backoff := baseBackoff * time.Duration(int64(1)<<uint(attempt))
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		wait := time.Duration(rand.Int63n(int64(backoff) + 1))
+
+		logger.Printf("Retrying after error (%v), attempt %d/%d\n", err, attempt+1, maxRetries)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return err
+}
+
+// progressReader wraps an io.Reader, reporting cumulative bytes read to a
+// ProgressReporter as they're consumed.
+type progressReader struct {
+	io.Reader
+	path     string
+	total    int64
+	read     int64
+	reporter ProgressReporter
+}
+
+func newProgressReader(r io.Reader, path string, total int64, reporter ProgressReporter) io.Reader {
+	if reporter == nil {
+		return r
+	}
+	return &progressReader{Reader: r, path: path, total: total, reporter: reporter}
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.Reader.Read(p)
+	pr.read += int64(n)
+	pr.reporter.Progress(pr.path, pr.read, pr.total)
+	return n, err
+}
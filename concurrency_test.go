@@ -0,0 +1,189 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestClickOnce_ConcurrencyLimit(t *testing.T) {
+	var co ClickOnce
+	if got := co.concurrencyLimit(); got != defaultConcurrency {
+		t.Errorf("concurrencyLimit() = %d, want default %d", got, defaultConcurrency)
+	}
+
+	co.SetConcurrency(10)
+	if got := co.concurrencyLimit(); got != 10 {
+		t.Errorf("concurrencyLimit() = %d, want 10", got)
+	}
+
+	co.SetConcurrency(0)
+	if got := co.concurrencyLimit(); got != defaultConcurrency {
+		t.Errorf("concurrencyLimit() with SetConcurrency(0) = %d, want default %d", got, defaultConcurrency)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	attempts := 0
+	err := retryWithBackoff(context.Background(), logger, func() error {
+		attempts++
+		if attempts < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("retryWithBackoff() ran fn %d times, want 3", attempts)
+	}
+}
+
+func TestRetryWithBackoff_GivesUp(t *testing.T) {
+	logger := log.New(ioutil.Discard, "", 0)
+
+	wantErr := errors.New("persistent")
+	attempts := 0
+	err := retryWithBackoff(context.Background(), logger, func() error {
+		attempts++
+		return wantErr
+	})
+	if err != wantErr {
+		t.Errorf("retryWithBackoff() = %v, want %v", err, wantErr)
+	}
+	if attempts != maxRetries+1 {
+		t.Errorf("retryWithBackoff() ran fn %d times, want %d", attempts, maxRetries+1)
+	}
+}
+
+func TestClickOnce_LimiterFor(t *testing.T) {
+	var co ClickOnce
+	if l := co.limiterFor("example.com"); l != nil {
+		t.Error("limiterFor() should be nil when no rate limit is configured")
+	}
+
+	co.SetRateLimit(5)
+	first := co.limiterFor("example.com")
+	if first == nil {
+		t.Fatal("limiterFor() should return a limiter once a rate limit is configured")
+	}
+	if second := co.limiterFor("example.com"); second != first {
+		t.Error("limiterFor() should reuse the same limiter for the same host")
+	}
+	if other := co.limiterFor("other.com"); other == first {
+		t.Error("limiterFor() should use a distinct limiter per host")
+	}
+}
+
+// TestClickOnce_RetrieveAllDeployedFilesConcurrencyOneNested guards against a
+// deadlock: with SetConcurrency(1), a manifest-processing goroutine must not
+// hold its sem token while recursing into a dependent manifest's own files,
+// since those files have to acquire from the very same sem to make progress.
+// Everything is served from a pre-populated cache so the test needs no
+// network I/O; an 8s deadline turns a deadlock into a clean failure.
+func TestClickOnce_RetrieveAllDeployedFilesConcurrencyOneNested(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "clickonce_nested_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	var co ClickOnce
+	co.SetLogger(log.New(ioutil.Discard, "", 0))
+	co.SetCacheDir(cacheDir)
+	co.SetConcurrency(1)
+	co.baseUrl, err = url.Parse("https://example.com/app.application")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafContent := []byte("leaf content")
+	subManifest := buildTestManifest(t, []testManifestFile{
+		{name: "leaf.txt", content: leafContent},
+	})
+
+	assembly := &coAssembly{
+		DependentAssembly: []coDependentAssembly{
+			{
+				coBase:         testCoBase(t, subManifest),
+				Codebase:       "sub.manifest",
+				DependencyType: "install",
+			},
+		},
+	}
+
+	if err := co.writeCache("sha256", testDigest(t, subManifest), subManifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := co.writeCache("sha256", testDigest(t, leafContent), leafContent); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+	defer cancel()
+
+	if err := co.retrieveAllDeployedFiles(ctx, assembly); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := co.deployedFiles["leaf.txt"]; !ok {
+		t.Error("leaf.txt should have been fetched through the nested manifest")
+	}
+}
+
+type testManifestFile struct {
+	name    string
+	content []byte
+}
+
+// buildTestManifest builds a minimal, unsigned ClickOnce manifest XML
+// declaring each file with its sha256 digest and size.
+func buildTestManifest(t *testing.T, files []testManifestFile) []byte {
+	t.Helper()
+
+	manifest := "<assembly>"
+	for _, f := range files {
+		manifest += fmt.Sprintf(
+			`<file name=%q size="%d"><hash><DigestMethod Algorithm="http://www.w3.org/2000/09/xmldsig#sha256"/><DigestValue>%s</DigestValue></hash></file>`,
+			f.name, len(f.content), testDigest(t, f.content))
+	}
+	manifest += "</assembly>"
+
+	return []byte(manifest)
+}
+
+// testCoBase builds the coBase a parent manifest would record for a
+// dependent assembly with this exact content.
+func testCoBase(t *testing.T, content []byte) coBase {
+	t.Helper()
+	return coBase{
+		Size: strconv.Itoa(len(content)),
+		Hash: coHash{
+			DigestMethod: coDigestMethod{Algorithm: "http://www.w3.org/2000/09/xmldsig#sha256"},
+			DigestValue:  testDigest(t, content),
+		},
+	}
+}
+
+func testDigest(t *testing.T, content []byte) string {
+	t.Helper()
+	digest, err := digestFor("sha256", content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
@@ -0,0 +1,271 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// A LockEntry records everything needed to strictly re-verify a single
+// deployed file against a previously resolved ClickOnce deployment.
+type LockEntry struct {
+	Path      string   `json:"path"`
+	URL       string   `json:"url"`
+	Size      int      `json:"size"`
+	Algorithm string   `json:"algorithm"`
+	Digest    string   `json:"digest"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+// A Lock is the content of a clickonce.lock file: the resolved URL, size,
+// digest and tags of every deployed file of a ClickOnce application.
+type Lock struct {
+	Files []LockEntry `json:"files"`
+}
+
+// entry returns the LockEntry for path, if any.
+func (l *Lock) entry(path string) (*LockEntry, bool) {
+	for i := range l.Files {
+		if l.Files[i].Path == path {
+			return &l.Files[i], true
+		}
+	}
+	return nil, false
+}
+
+// put inserts or updates the LockEntry for entry.Path.
+func (l *Lock) put(entry LockEntry) {
+	for i := range l.Files {
+		if l.Files[i].Path == entry.Path {
+			l.Files[i] = entry
+			return
+		}
+	}
+	l.Files = append(l.Files, entry)
+}
+
+// tagsMatch reports whether tags satisfies the include/exclude tag filters.
+// An empty include filter matches everything; any exclude match rejects it.
+func tagsMatch(tags, include, exclude []string) bool {
+	if len(exclude) > 0 {
+		for _, t := range exclude {
+			if containsTag(tags, t) {
+				return false
+			}
+		}
+	}
+
+	if len(include) == 0 {
+		return true
+	}
+
+	for _, t := range include {
+		if containsTag(tags, t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// loadLock reads a Lock from a JSON lock file at path.
+func loadLock(path string) (*Lock, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock Lock
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, err
+	}
+
+	return &lock, nil
+}
+
+// save writes the Lock as indented JSON to path.
+func (l *Lock) save(path string) error {
+	content, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, content, 0644)
+}
+
+// SetLockFile enables lock-driven reproducible fetches. If path already
+// exists, its entries are used to strictly verify subsequent downloads
+// instead of trusting the live manifest. Otherwise a new lock is created
+// and populated as files are downloaded, then written to path.
+func (co *ClickOnce) SetLockFile(path string) error {
+	if path == "" {
+		return errors.New("missing valid lock file path")
+	}
+
+	co.lockPath = path
+
+	if _, err := os.Stat(path); err == nil {
+		lock, err := loadLock(path)
+		if err != nil {
+			return err
+		}
+		co.lock = lock
+		return nil
+	}
+
+	co.lock = &Lock{}
+
+	return nil
+}
+
+// SetDynamic allows the lock to be refreshed when the live manifest's
+// digest legitimately changed, instead of failing as a tampering attempt.
+func (co *ClickOnce) SetDynamic(dynamic bool) {
+	co.dynamic = dynamic
+}
+
+// SetTags restricts downloads to lock entries tagged with at least one of tags.
+func (co *ClickOnce) SetTags(tags []string) {
+	co.tagInclude = tags
+}
+
+// SetNoTags excludes lock entries tagged with any of tags from the download.
+func (co *ClickOnce) SetNoTags(tags []string) {
+	co.tagExclude = tags
+}
+
+// SetFileTags assigns tags to deployedFilePath, recorded the next time it is
+// written to the lock. It has no effect once the entry already exists.
+func (co *ClickOnce) SetFileTags(deployedFilePath string, tags ...string) {
+	if co.pendingTags == nil {
+		co.pendingTags = make(map[string][]string)
+	}
+	co.pendingTags[deployedFilePath] = tags
+}
+
+// checkLock resolves the remote file info to use for deployedFilePath against
+// the lock, and records/updates the corresponding LockEntry. It reports
+// whether the file is wanted: false means it should be skipped because it
+// doesn't match the active tag filters. This applies to entries already in the lock and to new ones
+// tagged upfront with SetFileTags alike, so --tag/--notag also constrain
+// which files get added the first time a lock is populated.
+//
+// checkLock is called concurrently by the download worker pool, so co.lock
+// and co.pendingTags are guarded by co.mu, the same mutex that already
+// guards co.deployedFiles.
+func (co *ClickOnce) checkLock(deployedFilePath string, remote *remoteFile) (*remoteFile, bool, error) {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if co.lock == nil {
+		return remote, true, nil
+	}
+
+	entry, ok := co.lock.entry(deployedFilePath)
+
+	tags := co.pendingTags[deployedFilePath]
+	if ok {
+		tags = entry.Tags
+	}
+
+	if !tagsMatch(tags, co.tagInclude, co.tagExclude) {
+		return nil, false, nil
+	}
+
+	if ok && !co.dynamic {
+		if entry.Algorithm != remote.algorithm || entry.Digest != remote.digest || entry.Size != remote.size {
+			return nil, false, fmt.Errorf("lock mismatch for '%s': manifest no longer matches clickonce.lock, "+
+				"possible tampering (use SetDynamic to allow legitimate updates)", deployedFilePath)
+		}
+	}
+
+	newEntry := LockEntry{
+		Path:      deployedFilePath,
+		URL:       remote.url.String(),
+		Size:      remote.size,
+		Algorithm: remote.algorithm,
+		Digest:    remote.digest,
+		Tags:      tags,
+	}
+	co.lock.put(newEntry)
+
+	return remote, true, nil
+}
+
+// saveLock persists the lock file, if one is configured.
+func (co *ClickOnce) saveLock() error {
+	co.mu.Lock()
+	defer co.mu.Unlock()
+
+	if co.lock == nil || co.lockPath == "" {
+		return nil
+	}
+	return co.lock.save(co.lockPath)
+}
+
+// Verify re-hashes already-downloaded deployed files against the lock
+// without performing any network I/O, reporting a mismatch as an error.
+// Content is looked up in memory, then in the cache directory, then under
+// outputDir, in that order.
+func (co *ClickOnce) Verify() error {
+	if co.lock == nil {
+		return errors.New("no lock file configured")
+	}
+
+	for _, entry := range co.lock.Files {
+		content, err := co.loadForVerify(entry)
+		if err != nil {
+			return err
+		}
+
+		digest, err := digestFor(entry.Algorithm, content)
+		if err != nil {
+			return err
+		}
+
+		if digest != entry.Digest {
+			return fmt.Errorf("digest mismatch for '%s' against clickonce.lock", entry.Path)
+		}
+	}
+
+	return nil
+}
+
+// loadForVerify returns the already-downloaded content for a lock entry,
+// without any network I/O.
+func (co *ClickOnce) loadForVerify(entry LockEntry) ([]byte, error) {
+	if deployedFile, ok := co.deployedFiles[entry.Path]; ok {
+		return deployedFile.Content, nil
+	}
+
+	if content, ok := co.readCache(entry.Algorithm, entry.Digest); ok {
+		return content, nil
+	}
+
+	if co.outputDir != "" {
+		codebase := strings.Replace(entry.Path, "\\", "/", -1)
+		content, err := ioutil.ReadFile(path.Join(co.outputDir, codebase))
+		if err == nil {
+			return content, nil
+		}
+	}
+
+	return nil, fmt.Errorf("'%s' not found locally (in memory, cache or output dir), cannot verify without network", entry.Path)
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func mustParseURL(t *testing.T, raw string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestTagsMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		tags    []string
+		include []string
+		exclude []string
+		want    bool
+	}{
+		{"no filters", []string{"x"}, nil, nil, true},
+		{"included", []string{"core"}, []string{"core"}, nil, true},
+		{"not included", []string{"optional"}, []string{"core"}, nil, false},
+		{"excluded", []string{"debug"}, nil, []string{"debug"}, false},
+		{"exclude wins over include", []string{"core", "debug"}, []string{"core"}, []string{"debug"}, false},
+		{"untagged with include filter", nil, []string{"core"}, nil, false},
+		{"untagged with no filters", nil, nil, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tagsMatch(tt.tags, tt.include, tt.exclude); got != tt.want {
+				t.Errorf("tagsMatch(%v, %v, %v) = %v, want %v", tt.tags, tt.include, tt.exclude, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestClickOnce_CheckLockNewEntryTagFilter guards against the bug where a file
+// never previously seen in the lock bypassed --tag/--notag entirely: a tag
+// assigned upfront with SetFileTags must still be checked against the active
+// filters the first time an entry is populated.
+func TestClickOnce_CheckLockNewEntryTagFilter(t *testing.T) {
+	var co ClickOnce
+	co.lock = &Lock{}
+	co.SetFileTags("optional.dll", "optional")
+	co.SetNoTags([]string{"optional"})
+
+	remote := &remoteFile{url: mustParseURL(t, "https://example.com/optional.dll"), size: 1, digest: "abc", algorithm: "sha256"}
+
+	_, wanted, err := co.checkLock("optional.dll", remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wanted {
+		t.Error("checkLock() should have excluded a newly tagged file matching SetNoTags")
+	}
+	if _, ok := co.lock.entry("optional.dll"); ok {
+		t.Error("excluded file should not be recorded in the lock")
+	}
+}
+
+func TestClickOnce_CheckLockMismatch(t *testing.T) {
+	var co ClickOnce
+	co.lock = &Lock{Files: []LockEntry{
+		{Path: "app.exe", Algorithm: "sha256", Digest: "old", Size: 1},
+	}}
+
+	remote := &remoteFile{url: mustParseURL(t, "https://example.com/app.exe"), size: 1, digest: "new", algorithm: "sha256"}
+
+	if _, _, err := co.checkLock("app.exe", remote); err == nil {
+		t.Error("checkLock() should reject a digest mismatch when not dynamic")
+	}
+
+	co.SetDynamic(true)
+	if _, wanted, err := co.checkLock("app.exe", remote); err != nil || !wanted {
+		t.Errorf("checkLock() with SetDynamic(true) = wanted %v, err %v; want true, nil", wanted, err)
+	}
+}
+
+// TestClickOnce_CheckLockConcurrent exercises checkLock the way the download
+// worker pool actually calls it: many goroutines racing over the same
+// co.lock. Before co.mu guarded Lock.put's scan-then-append, concurrent
+// writers could lose or corrupt entries here; run with -race to catch it.
+func TestClickOnce_CheckLockConcurrent(t *testing.T) {
+	var co ClickOnce
+	co.lock = &Lock{}
+
+	const n = 50
+
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			deployedFilePath := fmt.Sprintf("file%d.dll", i)
+			remote := &remoteFile{
+				url:       mustParseURL(t, "https://example.com/"+deployedFilePath),
+				size:      i,
+				digest:    fmt.Sprintf("digest%d", i),
+				algorithm: "sha256",
+			}
+			if _, _, err := co.checkLock(deployedFilePath, remote); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := len(co.lock.Files); got != n {
+		t.Errorf("lock has %d entries after %d concurrent checkLock calls, want %d", got, n, n)
+	}
+	for i := 0; i < n; i++ {
+		deployedFilePath := fmt.Sprintf("file%d.dll", i)
+		if _, ok := co.lock.entry(deployedFilePath); !ok {
+			t.Errorf("'%s' missing from lock after concurrent checkLock calls", deployedFilePath)
+		}
+	}
+}
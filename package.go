@@ -0,0 +1,292 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/dsnet/compress/bzip2"
+)
+
+// A PackageFormat selects the archive format used by Package and LoadPackage.
+type PackageFormat int
+
+const (
+	// PackageZip is a .zip archive.
+	PackageZip PackageFormat = iota
+	// PackageTar is an uncompressed .tar archive.
+	PackageTar
+	// PackageTarGz is a gzip-compressed .tar.gz archive.
+	PackageTarGz
+	// PackageTarBzip2 is a bzip2-compressed .tar.bz2 archive.
+	PackageTarBzip2
+)
+
+// PackageFormatForPath maps a file extension (.zip, .tar, .tar.gz, .tar.bz2)
+// to a PackageFormat, mirroring the common VFS-open convention.
+func PackageFormatForPath(name string) (PackageFormat, error) {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return PackageZip, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return PackageTarGz, nil
+	case strings.HasSuffix(name, ".tar.bz2"), strings.HasSuffix(name, ".tbz2"):
+		return PackageTarBzip2, nil
+	case strings.HasSuffix(name, ".tar"):
+		return PackageTar, nil
+	default:
+		return 0, fmt.Errorf("unrecognized package extension for '%s'", name)
+	}
+}
+
+// packageManifestEntry describes one archived deployed file. Path is the
+// DeployedFiles key as is; the archive entry name is Path with forward slashes.
+type packageManifestEntry struct {
+	Path      string `json:"path"`
+	Type      coType `json:"type"`
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"`
+}
+
+// packageManifest is the top-level manifest.json bundled in a Package.
+type packageManifest struct {
+	Files []packageManifestEntry `json:"files"`
+}
+
+const packageManifestName = "manifest.json"
+
+// Package streams the current DeployedFiles into a zip or tar archive,
+// preserving the manifest-relative directory layout, alongside a top-level
+// manifest.json describing every file's type and digest. The result can be
+// handed to sandboxed runners, Docker builds or offline installers in place
+// of a directory tree, and later rehydrated with LoadPackage.
+func (co *ClickOnce) Package(w io.Writer, format PackageFormat) error {
+	manifest := packageManifest{Files: make([]packageManifestEntry, 0, len(co.deployedFiles))}
+	for deployedFilePath, deployedFile := range co.deployedFiles {
+		digest, err := digestFor("sha256", deployedFile.Content)
+		if err != nil {
+			return err
+		}
+		manifest.Files = append(manifest.Files, packageManifestEntry{
+			Path:      deployedFilePath,
+			Type:      deployedFile.Type,
+			Algorithm: "sha256",
+			Digest:    digest,
+		})
+	}
+
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case PackageZip:
+		return co.writeZipPackage(w, manifestJSON)
+	case PackageTar:
+		return co.writeTarPackage(w, manifestJSON)
+	case PackageTarGz:
+		gw := gzip.NewWriter(w)
+		if err := co.writeTarPackage(gw, manifestJSON); err != nil {
+			return err
+		}
+		return gw.Close()
+	case PackageTarBzip2:
+		bw, err := bzip2.NewWriter(w, nil)
+		if err != nil {
+			return err
+		}
+		if err := co.writeTarPackage(bw, manifestJSON); err != nil {
+			return err
+		}
+		return bw.Close()
+	default:
+		return errors.New("unsupported package format")
+	}
+}
+
+func (co *ClickOnce) writeZipPackage(w io.Writer, manifestJSON []byte) error {
+	zw := zip.NewWriter(w)
+
+	manifestWriter, err := zw.Create(packageManifestName)
+	if err != nil {
+		return err
+	}
+	if _, err := manifestWriter.Write(manifestJSON); err != nil {
+		return err
+	}
+
+	for deployedFilePath, deployedFile := range co.deployedFiles {
+		entryWriter, err := zw.Create(strings.Replace(deployedFilePath, "\\", "/", -1))
+		if err != nil {
+			return err
+		}
+		if _, err := entryWriter.Write(deployedFile.Content); err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func (co *ClickOnce) writeTarPackage(w io.Writer, manifestJSON []byte) error {
+	tw := tar.NewWriter(w)
+
+	if err := tw.WriteHeader(&tar.Header{Name: packageManifestName, Size: int64(len(manifestJSON)), Mode: 0644}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return err
+	}
+
+	for deployedFilePath, deployedFile := range co.deployedFiles {
+		name := strings.Replace(deployedFilePath, "\\", "/", -1)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Size: int64(len(deployedFile.Content)), Mode: 0644}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(deployedFile.Content); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// LoadPackage rehydrates DeployedFiles from an archive written by Package
+// and re-verifies every file against the bundled manifest.json's digests, so
+// Get-style APIs continue to work against a cached archive with no network.
+// The archive format is detected from its content.
+func (co *ClickOnce) LoadPackage(r io.Reader) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	files, manifestJSON, err := readPackageArchive(content)
+	if err != nil {
+		return err
+	}
+
+	var manifest packageManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return err
+	}
+
+	deployedFiles := make(map[string]DeployedFile, len(manifest.Files))
+	for _, entry := range manifest.Files {
+		content, ok := files[strings.Replace(entry.Path, "\\", "/", -1)]
+		if !ok {
+			return fmt.Errorf("'%s' listed in manifest.json but missing from package", entry.Path)
+		}
+
+		digest, err := digestFor(entry.Algorithm, content)
+		if err != nil {
+			return err
+		}
+		if digest != entry.Digest {
+			return fmt.Errorf("digest mismatch for '%s' in package", entry.Path)
+		}
+
+		deployedFiles[entry.Path] = DeployedFile{Type: entry.Type, Content: content}
+	}
+
+	co.deployedFiles = deployedFiles
+	co.offline = true
+
+	return nil
+}
+
+// readPackageArchive extracts every file in content, sniffing whether it's
+// a zip, gzip- or bzip2-compressed tar, or a plain tar, and returns its
+// entries keyed by path along with the bundled manifest.json.
+func readPackageArchive(content []byte) (map[string][]byte, []byte, error) {
+	var tr *tar.Reader
+
+	switch {
+	case bytes.HasPrefix(content, []byte("PK")):
+		zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		files := make(map[string][]byte, len(zr.File))
+		var manifestJSON []byte
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			if err != nil {
+				return nil, nil, err
+			}
+			data, err := ioutil.ReadAll(rc)
+			_ = rc.Close()
+			if err != nil {
+				return nil, nil, err
+			}
+			if path.Clean(f.Name) == packageManifestName {
+				manifestJSON = data
+				continue
+			}
+			files[f.Name] = data
+		}
+		if manifestJSON == nil {
+			return nil, nil, errors.New("package is missing manifest.json")
+		}
+		return files, manifestJSON, nil
+
+	case bytes.HasPrefix(content, []byte{0x1f, 0x8b}):
+		gr, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, nil, err
+		}
+		tr = tar.NewReader(gr)
+
+	case bytes.HasPrefix(content, []byte("BZh")):
+		br, err := bzip2.NewReader(bytes.NewReader(content), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		tr = tar.NewReader(br)
+
+	default:
+		tr = tar.NewReader(bytes.NewReader(content))
+	}
+
+	files := make(map[string][]byte)
+	var manifestJSON []byte
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if path.Clean(header.Name) == packageManifestName {
+			manifestJSON = data
+			continue
+		}
+		files[header.Name] = data
+	}
+	if manifestJSON == nil {
+		return nil, nil, errors.New("package is missing manifest.json")
+	}
+
+	return files, manifestJSON, nil
+}
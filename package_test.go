@@ -0,0 +1,100 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPackageFormatForPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want PackageFormat
+	}{
+		{"app.zip", PackageZip},
+		{"app.tar", PackageTar},
+		{"app.tar.gz", PackageTarGz},
+		{"app.tgz", PackageTarGz},
+		{"app.tar.bz2", PackageTarBzip2},
+		{"app.tbz2", PackageTarBzip2},
+	}
+
+	for _, tt := range tests {
+		got, err := PackageFormatForPath(tt.name)
+		if err != nil {
+			t.Errorf("PackageFormatForPath(%q) error = %v", tt.name, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("PackageFormatForPath(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := PackageFormatForPath("app.exe"); err == nil {
+		t.Error("PackageFormatForPath() should reject an unrecognized extension")
+	}
+}
+
+func TestClickOnce_PackageLoadPackage(t *testing.T) {
+	formats := []PackageFormat{PackageZip, PackageTar, PackageTarGz, PackageTarBzip2}
+
+	for _, format := range formats {
+		var co ClickOnce
+		co.deployedFiles = map[string]DeployedFile{
+			"app.exe":          {Type: AssemblyDependency, Content: []byte("exe content")},
+			"data\\readme.txt": {Type: NonAssemblyFile, Content: []byte("readme content")},
+		}
+
+		var buf bytes.Buffer
+		if err := co.Package(&buf, format); err != nil {
+			t.Fatalf("format %v: Package() error = %v", format, err)
+		}
+
+		var loaded ClickOnce
+		if err := loaded.LoadPackage(&buf); err != nil {
+			t.Fatalf("format %v: LoadPackage() error = %v", format, err)
+		}
+
+		if !loaded.offline {
+			t.Errorf("format %v: LoadPackage() should mark the instance offline", format)
+		}
+
+		for path, file := range co.deployedFiles {
+			got, ok := loaded.deployedFiles[path]
+			if !ok {
+				t.Errorf("format %v: %q missing after LoadPackage()", format, path)
+				continue
+			}
+			if string(got.Content) != string(file.Content) {
+				t.Errorf("format %v: %q content = %q, want %q", format, path, got.Content, file.Content)
+			}
+			if got.Type != file.Type {
+				t.Errorf("format %v: %q type = %v, want %v", format, path, got.Type, file.Type)
+			}
+		}
+	}
+}
+
+func TestClickOnce_LoadPackageDigestMismatch(t *testing.T) {
+	var co ClickOnce
+	co.deployedFiles = map[string]DeployedFile{
+		"app.exe": {Type: AssemblyDependency, Content: []byte("exe content")},
+	}
+
+	var buf bytes.Buffer
+	if err := co.Package(&buf, PackageTar); err != nil {
+		t.Fatal(err)
+	}
+
+	// PackageTar stores entries uncompressed, so the content bytes can be
+	// corrupted in place without reconstructing the archive.
+	tampered := bytes.Replace(buf.Bytes(), []byte("exe content"), []byte("tamperedd!!"), 1)
+
+	var loaded ClickOnce
+	if err := loaded.LoadPackage(bytes.NewReader(tampered)); err == nil {
+		t.Error("LoadPackage() should reject content that no longer matches manifest.json's digest")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// A SignaturePolicy controls how a ClickOnce manifest's Authenticode/XMLDSig
+// signature is treated.
+type SignaturePolicy int
+
+const (
+	// SignatureOptional verifies a present signature but accepts an
+	// unsigned manifest. This is the default.
+	SignatureOptional SignaturePolicy = iota
+
+	// SignatureRequired rejects a manifest with no <Signature> element.
+	SignatureRequired
+
+	// SignatureIgnore skips signature verification entirely.
+	SignatureIgnore
+)
+
+// SetTrustedRoots sets the certificate authorities a manifest's signing
+// certificate must chain to. If unset, the signing certificate's
+// cryptographic validity is still checked, but its chain of trust is not.
+func (co *ClickOnce) SetTrustedRoots(pool *x509.CertPool) {
+	co.trustedRoots = pool
+}
+
+// SetSignaturePolicy sets how Init treats a manifest's signature. The
+// default is SignatureOptional.
+func (co *ClickOnce) SetSignaturePolicy(policy SignaturePolicy) {
+	co.signaturePolicy = policy
+}
+
+// Publisher returns the subject of the certificate that signed the
+// application manifest, or "" if it wasn't signed, or signature
+// verification was skipped via SignatureIgnore.
+func (co *ClickOnce) Publisher() string {
+	return co.publisher
+}
+
+// verifyManifestSignature checks the enveloped XMLDSig <Signature> of a
+// ClickOnce manifest, if any, and records the signing certificate's
+// publisher identity on co.
+func (co *ClickOnce) verifyManifestSignature(data []byte) error {
+	if co.signaturePolicy == SignatureIgnore {
+		return nil
+	}
+
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(data); err != nil {
+		return err
+	}
+
+	root := doc.Root()
+	if root == nil {
+		return errors.New("empty manifest")
+	}
+
+	sigElement := root.FindElement("./Signature")
+	if sigElement == nil {
+		if co.signaturePolicy == SignatureRequired {
+			return errors.New("manifest is not signed")
+		}
+		return nil
+	}
+
+	certs, err := embeddedCertificates(sigElement)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		return errors.New("signature has no embedded certificate")
+	}
+	signingCert := certs[0]
+
+	// Validate the enveloped signature (Exclusive C14N, Reference digest
+	// over the manifest root) against the embedded certificate's key.
+	validationCtx := dsig.NewDefaultValidationContext(&dsig.MemoryX509CertificateStore{Roots: certs})
+	if _, err := validationCtx.Validate(root); err != nil {
+		return fmt.Errorf("manifest signature verification failed: %w", err)
+	}
+
+	if co.trustedRoots != nil {
+		if _, err := signingCert.Verify(x509.VerifyOptions{Roots: co.trustedRoots}); err != nil {
+			return fmt.Errorf("untrusted signing certificate: %w", err)
+		}
+	}
+
+	co.publisher = signingCert.Subject.String()
+
+	return nil
+}
+
+// embeddedCertificates parses every <X509Certificate> under sigElement.
+func embeddedCertificates(sigElement *etree.Element) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+
+	for _, el := range sigElement.FindElements(".//X509Certificate") {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(el.Text()))
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Stefano Cotta Ramusino. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package clickonce
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	"github.com/beevik/etree"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+// signedTestManifest builds a minimal ClickOnce-shaped manifest, signs it
+// (enveloped) with a freshly generated, self-signed certificate, and returns
+// its serialized bytes along with the signing certificate itself.
+func signedTestManifest(t *testing.T) ([]byte, *x509.Certificate) {
+	t.Helper()
+
+	keyStore := dsig.RandomKeyStoreForTest()
+
+	root := &etree.Element{Tag: "assembly"}
+	root.CreateElement("file").CreateAttr("name", "app.exe")
+
+	signed, err := dsig.NewDefaultSigningContext(keyStore).SignEnveloped(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := etree.NewDocument()
+	doc.SetRoot(signed)
+
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memKeyStore := keyStore.(*dsig.MemoryX509KeyStore)
+	_, rawCert, err := memKeyStore.GetKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(rawCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data, cert
+}
+
+func TestClickOnce_VerifyManifestSignatureUnsigned(t *testing.T) {
+	var co ClickOnce
+	if err := co.verifyManifestSignature([]byte("<assembly/>")); err != nil {
+		t.Errorf("unsigned manifest with SignatureOptional should pass, got %v", err)
+	}
+	if co.Publisher() != "" {
+		t.Errorf("Publisher() = %q, want empty for an unsigned manifest", co.Publisher())
+	}
+}
+
+func TestClickOnce_VerifyManifestSignatureRequired(t *testing.T) {
+	var co ClickOnce
+	co.SetSignaturePolicy(SignatureRequired)
+	if err := co.verifyManifestSignature([]byte("<assembly/>")); err == nil {
+		t.Error("unsigned manifest with SignatureRequired should fail")
+	}
+}
+
+func TestClickOnce_VerifyManifestSignatureIgnore(t *testing.T) {
+	var co ClickOnce
+	co.SetSignaturePolicy(SignatureIgnore)
+	if err := co.verifyManifestSignature([]byte("not even xml")); err != nil {
+		t.Errorf("SignatureIgnore should skip parsing entirely, got %v", err)
+	}
+}
+
+func TestClickOnce_VerifyManifestSignatureValid(t *testing.T) {
+	data, cert := signedTestManifest(t)
+
+	var co ClickOnce
+	if err := co.verifyManifestSignature(data); err != nil {
+		t.Fatalf("valid signature should verify, got %v", err)
+	}
+	if co.Publisher() != cert.Subject.String() {
+		t.Errorf("Publisher() = %q, want %q", co.Publisher(), cert.Subject.String())
+	}
+}
+
+func TestClickOnce_VerifyManifestSignatureTamperedContent(t *testing.T) {
+	data, _ := signedTestManifest(t)
+
+	tampered := []byte(strings.Replace(string(data), "app.exe", "evil.exe", 1))
+
+	var co ClickOnce
+	if err := co.verifyManifestSignature(tampered); err == nil {
+		t.Error("a manifest modified after signing should fail verification")
+	}
+}
+
+func TestClickOnce_VerifyManifestSignatureTrustedRoots(t *testing.T) {
+	data, cert := signedTestManifest(t)
+
+	var co ClickOnce
+	trusted := x509.NewCertPool()
+	trusted.AddCert(cert)
+	co.SetTrustedRoots(trusted)
+
+	if err := co.verifyManifestSignature(data); err != nil {
+		t.Errorf("signing cert present in trusted roots should verify, got %v", err)
+	}
+}
+
+func TestClickOnce_VerifyManifestSignatureUntrustedRoots(t *testing.T) {
+	data, _ := signedTestManifest(t)
+
+	var co ClickOnce
+	// An empty pool means the signing certificate can't chain to anything.
+	co.SetTrustedRoots(x509.NewCertPool())
+
+	if err := co.verifyManifestSignature(data); err == nil {
+		t.Error("signing cert absent from trusted roots should fail verification")
+	}
+}